@@ -0,0 +1,56 @@
+package db
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrOperationInProgress is returned by VolumeLocks.TryAcquire's
+// callers when another goroutine already holds the lock for the
+// requested key. Unlike epoch.mu, which only protects a single
+// counter, this signals that an entire operation -- volume creation,
+// a sync, a snapshot -- is already underway and must not be
+// interleaved with another one for the same key.
+var ErrOperationInProgress = errors.New("operation already in progress")
+
+// VolumeLocks serializes operations that must not run concurrently
+// for the same key. Acquisition never blocks: a caller that loses the
+// race gets told immediately, via ErrOperationInProgress, rather than
+// queuing behind the winner.
+type VolumeLocks struct {
+	mu   sync.Mutex
+	held map[string]struct{}
+}
+
+// NewVolumeLocks returns an empty VolumeLocks, ready to use.
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{
+		held: make(map[string]struct{}),
+	}
+}
+
+// Locks is the process-wide lock table used to serialize volume
+// creation, sync, and snapshot operations. It is a singleton because
+// those operations must be mutually exclusive across the whole bazil
+// process, not just within a single transaction.
+var Locks = NewVolumeLocks()
+
+// TryAcquire attempts to take the lock for key, returning false if it
+// is already held.
+func (l *VolumeLocks) TryAcquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, busy := l.held[key]; busy {
+		return false
+	}
+	l.held[key] = struct{}{}
+	return true
+}
+
+// Release gives up the lock for key. It is a no-op if key is not
+// currently held.
+func (l *VolumeLocks) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, key)
+}
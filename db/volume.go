@@ -60,6 +60,17 @@ func (b *Volumes) GetByName(name string) (*Volume, error) {
 	return v, nil
 }
 
+// SetReadOnly is a convenience wrapper around GetByName followed by
+// Volume.SetReadOnly. The caller is responsible for running it inside
+// a writable transaction.
+func (b *Volumes) SetReadOnly(name string, readOnly bool) error {
+	v, err := b.GetByName(name)
+	if err != nil {
+		return err
+	}
+	return v.SetReadOnly(readOnly)
+}
+
 func (b *Volumes) GetByVolumeID(volID *VolumeID) (*Volume, error) {
 	bv := b.volumes.Bucket(volID[:])
 	if bv == nil {
@@ -79,6 +90,12 @@ func (b *Volumes) Create(name string, storage string, sharingKey *SharingKey) (*
 	if name == "" {
 		return nil, ErrVolNameInvalid
 	}
+	lockKey := "volname|" + name
+	if !Locks.TryAcquire(lockKey) {
+		return nil, ErrOperationInProgress
+	}
+	defer Locks.Release(lockKey)
+
 	n := []byte(name)
 	if v := b.names.Get(n); v != nil {
 		return nil, ErrVolNameExist
@@ -152,6 +169,27 @@ func (v *Volume) Storage() *VolumeStorage {
 	return &VolumeStorage{b}
 }
 
+var keyReadOnly = []byte("read-only")
+
+// ReadOnly reports whether the volume is currently frozen against
+// mutation, as set by SetReadOnly.
+func (v *Volume) ReadOnly() (bool, error) {
+	val := v.b.Get(keyReadOnly)
+	return len(val) == 1 && val[0] == 1, nil
+}
+
+// SetReadOnly freezes or unfreezes the volume. While read-only,
+// bazil's FUSE layer refuses mutating operations with EROFS and
+// SyncReceive refuses to apply incoming changes, so an operator can
+// safely back up or verify the volume without unmounting it.
+func (v *Volume) SetReadOnly(readOnly bool) error {
+	val := []byte{0}
+	if readOnly {
+		val[0] = 1
+	}
+	return v.b.Put(keyReadOnly, val)
+}
+
 // DirBucket returns a bolt bucket for storing directory contents in.
 func (v *Volume) DirBucket() *bolt.Bucket {
 	return v.b.Bucket(volumeStateDir)
@@ -0,0 +1,199 @@
+package fs
+
+import (
+	"os"
+	"sync"
+
+	"bazil.org/bazil/db"
+	"bazil.org/bazil/fs/inodes"
+	wiresnap "bazil.org/bazil/fs/snap/wire"
+	"bazil.org/bazil/fs/wire"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// dir is a directory node in a Volume's FUSE tree.
+type dir struct {
+	fs     *Volume
+	inode  uint64
+	parent *dir
+
+	mu   sync.Mutex
+	name string
+}
+
+func newDir(fs *Volume, inode uint64, parent *dir, name string) *dir {
+	return &dir{fs: fs, inode: inode, parent: parent, name: name}
+}
+
+var _ fs.Node = (*dir)(nil)
+var _ node = (*dir)(nil)
+
+func (d *dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = d.inode
+	a.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (d *dir) setName(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.name = name
+}
+
+func (d *dir) marshal() (*wire.Dirent, error) {
+	return &wire.Dirent{
+		Inode: d.inode,
+		Dir:   &wire.Dir{},
+	}, nil
+}
+
+// snapshot records this directory and everything beneath it.
+func (d *dir) snapshot(ctx context.Context, tx *db.Tx) (*wiresnap.Dirent, error) {
+	return snapshotDir(d.fs.bucket(tx), d.inode, d.name)
+}
+
+func snapshotDir(bucket *db.Volume, inode uint64, name string) (*wiresnap.Dirent, error) {
+	sd := &wiresnap.Dirent{
+		Name: name,
+		Dir:  &wiresnap.Dir{},
+	}
+	c := bucket.Dirs().List(inode)
+	for item := c.First(); item != nil; item = c.Next() {
+		var tmp wire.Dirent
+		if err := item.Unmarshal(&tmp); err != nil {
+			return nil, err
+		}
+		switch {
+		case tmp.Dir != nil:
+			child, err := snapshotDir(bucket, tmp.Inode, item.Name())
+			if err != nil {
+				return nil, err
+			}
+			sd.Children = append(sd.Children, child)
+		case tmp.File != nil:
+			sd.Children = append(sd.Children, &wiresnap.Dirent{
+				Name: item.Name(),
+				File: &wiresnap.File{Manifest: tmp.File.Manifest},
+			})
+		}
+	}
+	return sd, nil
+}
+
+// putChild writes de as the dirent for name under d and marks the
+// volume epoch dirty. The caller chooses de's inode. Caller must run
+// this inside a writable transaction.
+func (d *dir) putChild(tx *db.Tx, name string, de *wire.Dirent) error {
+	if err := d.fs.bucket(tx).Dirs().Put(d.inode, name, de); err != nil {
+		return err
+	}
+	d.fs.dirtyEpoch()
+	return nil
+}
+
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	inode := inodes.Dynamic(d.inode, req.Name)
+	de := &wire.Dirent{
+		Inode: inode,
+		Dir:   &wire.Dir{},
+	}
+	if err := d.fs.db.Update(func(tx *db.Tx) error {
+		return d.putChild(tx, req.Name, de)
+	}); err != nil {
+		return nil, err
+	}
+	return newDir(d.fs, inode, d, req.Name), nil
+}
+
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+
+	inode := inodes.Dynamic(d.inode, req.Name)
+	de := &wire.Dirent{
+		Inode: inode,
+		File:  &wire.File{},
+	}
+	if err := d.fs.db.Update(func(tx *db.Tx) error {
+		return d.putChild(tx, req.Name, de)
+	}); err != nil {
+		return nil, nil, err
+	}
+	f := newFile(d.fs, inode, d, req.Name)
+	return f, f, nil
+}
+
+func (d *dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	inode := inodes.Dynamic(d.inode, req.NewName)
+	de := &wire.Dirent{
+		Inode:   inode,
+		Symlink: &wire.Symlink{Target: req.Target},
+	}
+	if err := d.fs.db.Update(func(tx *db.Tx) error {
+		return d.putChild(tx, req.NewName, de)
+	}); err != nil {
+		return nil, err
+	}
+	return newSymlink(d.fs, inode, req.NewName, req.Target), nil
+}
+
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+
+	return d.fs.db.Update(func(tx *db.Tx) error {
+		bucket := d.fs.bucket(tx)
+		if err := bucket.Dirs().Delete(d.inode, req.Name); err != nil {
+			return err
+		}
+		d.fs.dirtyEpoch()
+		return nil
+	})
+}
+
+func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+
+	nd, ok := newDir.(*dir)
+	if !ok {
+		return fuse.EIO
+	}
+
+	return d.fs.db.Update(func(tx *db.Tx) error {
+		bucket := d.fs.bucket(tx)
+		de, err := bucket.Dirs().Get(d.inode, req.OldName)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Dirs().Put(nd.inode, req.NewName, de); err != nil {
+			return err
+		}
+		if err := bucket.Dirs().Delete(d.inode, req.OldName); err != nil {
+			return err
+		}
+		d.fs.dirtyEpoch()
+		return nil
+	})
+}
+
+func (d *dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+	d.fs.dirtyEpoch()
+	return d.Attr(ctx, &resp.Attr)
+}
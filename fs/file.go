@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"sync"
+
+	"bazil.org/bazil/db"
+	"bazil.org/bazil/fs/wire"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// file is a regular file node in a Volume's FUSE tree.
+type file struct {
+	fs     *Volume
+	inode  uint64
+	parent *dir
+
+	mu       sync.Mutex
+	name     string
+	manifest []byte
+}
+
+func newFile(fs *Volume, inode uint64, parent *dir, name string) *file {
+	return &file{fs: fs, inode: inode, parent: parent, name: name}
+}
+
+var _ fs.Node = (*file)(nil)
+var _ fs.Handle = (*file)(nil)
+var _ node = (*file)(nil)
+
+func (f *file) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = f.inode
+	a.Mode = 0644
+	return nil
+}
+
+func (f *file) setName(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.name = name
+}
+
+func (f *file) marshal() (*wire.Dirent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &wire.Dirent{
+		Inode: f.inode,
+		File:  &wire.File{Manifest: f.manifest},
+	}, nil
+}
+
+func (f *file) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if err := f.fs.checkWritable(); err != nil {
+		return err
+	}
+	f.fs.dirtyEpoch()
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// Write stores req.Data as the file's entire new content. bazil does
+// not yet support partial writes to an existing manifest; every Write
+// replaces the manifest wholesale.
+func (f *file) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if err := f.fs.checkWritable(); err != nil {
+		return err
+	}
+
+	manifest, err := f.fs.chunkStore.Add(req.Data)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.manifest = manifest
+	f.mu.Unlock()
+
+	if f.parent != nil {
+		de, err := f.marshal()
+		if err != nil {
+			return err
+		}
+		if err := f.fs.db.Update(func(tx *db.Tx) error {
+			return f.parent.putChild(tx, f.name, de)
+		}); err != nil {
+			return err
+		}
+	}
+
+	resp.Size = len(req.Data)
+	return nil
+}
@@ -3,7 +3,6 @@ package fs
 import (
 	"fmt"
 	"log"
-	"path"
 	"strings"
 	"sync"
 
@@ -14,7 +13,6 @@ import (
 	wiresnap "bazil.org/bazil/fs/snap/wire"
 	"bazil.org/bazil/fs/wire"
 	"bazil.org/bazil/peer"
-	wirepeer "bazil.org/bazil/peer/wire"
 	"bazil.org/bazil/tokens"
 	"bazil.org/fuse/fs"
 	"golang.org/x/net/context"
@@ -35,6 +33,8 @@ type Volume struct {
 		// Have changes been made since epoch ticked?
 		dirty bool
 	}
+
+	readOnly readOnlyState
 }
 
 var _ = fs.FS(&Volume{})
@@ -66,7 +66,7 @@ func Open(db *db.DB, chunkStore chunks.Store, volumeID *db.VolumeID, pubKey *pee
 	fs.db = db
 	fs.volID = *volumeID
 	fs.pubKey = *pubKey
-	fs.chunkStore = chunkStore
+	fs.chunkStore = instrumentChunkStore(chunkStore, volumeLabel(volumeID))
 	fs.root = newDir(fs, tokens.InodeRoot, nil, "")
 	// assume we crashed, to be safe
 	fs.epoch.dirty = true
@@ -82,6 +82,13 @@ func (v *Volume) initFromDB(tx *db.Tx) error {
 		return err
 	}
 	v.epoch.ticks = epoch
+
+	readOnly, err := v.bucket(tx).ReadOnly()
+	if err != nil {
+		return err
+	}
+	v.readOnly.set(readOnly)
+
 	return nil
 }
 
@@ -98,6 +105,12 @@ var _ = fs.FSInodeGenerator(&Volume{})
 // Snapshot records a snapshot of the volume. The Snapshot message
 // itself has not been persisted yet.
 func (v *Volume) Snapshot(ctx context.Context, tx *db.Tx) (*wiresnap.Snapshot, error) {
+	lockKey := v.lockKey()
+	if !db.Locks.TryAcquire(lockKey) {
+		return nil, db.ErrOperationInProgress
+	}
+	defer db.Locks.Release(lockKey)
+
 	snapshot := &wiresnap.Snapshot{}
 	sde, err := v.root.snapshot(ctx, tx)
 	if err != nil {
@@ -112,7 +125,7 @@ func (v *Volume) Snapshot(ctx context.Context, tx *db.Tx) (*wiresnap.Snapshot, e
 // TODO nextEpoch only needs to tick if the volume is seeing mutation;
 // unmounted is safe?
 func (v *Volume) nextEpoch(vb *db.Volume) error {
-	if !v.epoch.dirty {
+	if !v.epoch.dirty || v.readOnly.get() {
 		return nil
 	}
 	n, err := vb.NextEpoch()
@@ -127,7 +140,9 @@ func (v *Volume) nextEpoch(vb *db.Volume) error {
 func (v *Volume) dirtyEpoch() clock.Epoch {
 	v.epoch.mu.Lock()
 	defer v.epoch.mu.Unlock()
-	v.epoch.dirty = true
+	if !v.readOnly.get() {
+		v.epoch.dirty = true
+	}
 	return v.epoch.ticks
 }
 
@@ -157,143 +172,14 @@ func splitPath(p string) (string, string) {
 	return p[:idx], p[idx+1:]
 }
 
-func (v *Volume) SyncSend(ctx context.Context, dirPath string, send func(*wirepeer.VolumeSyncPullItem) error) error {
-	dirPath = path.Clean("/" + dirPath)[1:]
-
-	// First, start a new epoch so all mutations happen after the
-	// clocks that are included in the snapshot.
-	//
-	// We hold the lock over to prevent using clocks from using the
-	// new epoch until we have a snapshot started.
-	v.epoch.mu.Lock()
-	locked := true
-	defer func() {
-		if locked {
-			v.epoch.mu.Unlock()
-		}
-	}()
-	if _, err := v.cleanEpoch(); err != nil {
-		return err
+// lockKey identifies this volume for db.Locks, optionally scoped to a
+// directory path within it.
+func (v *Volume) lockKey(parts ...string) string {
+	key := fmt.Sprintf("%x", v.volID[:])
+	for _, p := range parts {
+		key += "|" + p
 	}
-	sync := func(tx *db.Tx) error {
-		v.epoch.mu.Unlock()
-		locked = false
-
-		// NOT HOLDING THE LOCK, accessing database snapshot ONLY
-
-		bucket := v.bucket(tx)
-		dirs := bucket.Dirs()
-		clocks := bucket.Clock()
-
-		dirInode := v.root.inode
-		var dirDE *wire.Dirent
-
-		for dirPath != "" {
-			var seg string
-			seg, dirPath = splitPath(dirPath)
-
-			de, err := dirs.Get(dirInode, seg)
-			if err != nil {
-				return err
-			}
-			// Might not be a dir anymore but that'll just trigger
-			// ENOENT on the next round.
-			dirInode = de.Inode
-			dirDE = de
-		}
-
-		// If it's not the root, make sure it's a directory; List below doesn't.
-		if dirDE != nil && dirDE.Dir == nil {
-			msg := &wirepeer.VolumeSyncPullItem{
-				Error: wirepeer.VolumeSyncPullItem_NOT_A_DIRECTORY,
-			}
-			if err := send(msg); err != nil {
-				return err
-			}
-			return nil
-		}
-
-		msg := &wirepeer.VolumeSyncPullItem{
-			Peers: map[uint32][]byte{
-				// PeerID 0 always refers to myself.
-				0: v.pubKey[:],
-			},
-		}
-
-		cursor := tx.Peers().Cursor()
-		for peer := cursor.First(); peer != nil; peer = cursor.Next() {
-			// filter what ids are returned here to include only peers
-			// authorized for current volumes; avoids leaking information
-			// about all of our peers.
-			if !peer.Volumes().IsAllowed(bucket) {
-				continue
-			}
-
-			// TODO hardcoded knowledge of size of peer.ID
-			msg.Peers[uint32(peer.ID())] = peer.Pub()[:]
-		}
-
-		c := dirs.List(dirInode)
-		const maxBatch = 1000
-		for item := c.First(); item != nil; item = c.Next() {
-			name := item.Name()
-
-			var tmp wire.Dirent
-			if err := item.Unmarshal(&tmp); err != nil {
-				return err
-			}
-
-			de := &wirepeer.Dirent{
-				Name: name,
-			}
-			switch {
-			case tmp.File != nil:
-				de.File = &wirepeer.File{
-					Manifest: tmp.File.Manifest,
-				}
-			case tmp.Dir != nil:
-				de.Dir = &wirepeer.Dir{}
-			default:
-				return fmt.Errorf("unknown dirent type: %v", tmp)
-			}
-
-			clock, err := clocks.Get(dirInode, name)
-			if err != nil {
-				return err
-			}
-			// TODO more complex db api would avoid unmarshal-marshal
-			// hoops
-			clockBuf, err := clock.MarshalBinary()
-			if err != nil {
-				return err
-			}
-			de.Clock = clockBuf
-
-			// TODO executable, xattr, acl
-			// TODO mtime
-
-			msg.Children = append(msg.Children, de)
-
-			if len(msg.Children) > maxBatch {
-				if err := send(msg); err != nil {
-					return err
-				}
-				msg.Reset()
-			}
-		}
-
-		if len(msg.Children) > 0 || msg.Peers != nil {
-			if err := send(msg); err != nil {
-				return err
-			}
-		}
-
-		return nil
-	}
-	if err := v.db.View(sync); err != nil {
-		return err
-	}
-	return nil
+	return key
 }
 
 type node interface {
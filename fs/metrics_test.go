@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeChunkStore is a chunks.Store test double: Get returns a canned
+// value or error for a given key, and Add always succeeds, letting
+// tests drive hits, misses, and errors deterministically.
+type fakeChunkStore struct {
+	values map[string][]byte
+}
+
+func newFakeChunkStore() *fakeChunkStore {
+	return &fakeChunkStore{values: make(map[string][]byte)}
+}
+
+func (f *fakeChunkStore) Get(key []byte) ([]byte, error) {
+	buf, ok := f.values[string(key)]
+	if !ok {
+		return nil, errors.New("fakeChunkStore: no such key")
+	}
+	return buf, nil
+}
+
+func (f *fakeChunkStore) Add(buf []byte) ([]byte, error) {
+	key := []byte(string(buf)) // identity "hash" is enough for this test double
+	f.values[string(key)] = buf
+	return key, nil
+}
+
+func TestInstrumentedChunkStore(t *testing.T) {
+	const volume = "test-volume-counts"
+	fake := newFakeChunkStore()
+	store := instrumentChunkStore(fake, volume)
+
+	key, err := store.Add([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := store.Get(key); err != nil {
+		t.Fatalf("Get hit: %v", err)
+	}
+	if _, err := store.Get([]byte("missing")); err == nil {
+		t.Fatal("Get miss: expected error, got nil")
+	}
+
+	if got, want := testutil.ToFloat64(chunksOpsTotal.WithLabelValues("add", volume)), 1.0; got != want {
+		t.Errorf("add ops = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(chunksOpsTotal.WithLabelValues("get", volume)), 2.0; got != want {
+		t.Errorf("get ops = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(chunksErrorsTotal.WithLabelValues("get", volume)), 1.0; got != want {
+		t.Errorf("get errors = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(chunksBytesTotal.WithLabelValues("add", volume, "in")), 5.0; got != want {
+		t.Errorf("add bytes in = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(chunksBytesTotal.WithLabelValues("get", volume, "out")), 5.0; got != want {
+		t.Errorf("get bytes out = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"errors"
+	"sync"
+
+	"bazil.org/bazil/db"
+	"bazil.org/fuse"
+)
+
+// ErrVolumeReadOnly is returned by SyncReceive when the volume is
+// read-only and a peer tries to push changes to it. Callers report it
+// back to the pushing peer; FUSE mutating operations instead
+// translate read-only into fuse.EROFS directly, as the kernel
+// expects.
+var ErrVolumeReadOnly = errors.New("volume is read-only")
+
+// readOnlyState caches Volume.ReadOnly so FUSE operations, which run
+// far more often than the flag changes, don't need a database
+// round-trip on every call.
+type readOnlyState struct {
+	mu    sync.Mutex
+	value bool
+}
+
+func (r *readOnlyState) get() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.value
+}
+
+func (r *readOnlyState) set(value bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.value = value
+}
+
+// ReadOnly reports whether the volume is currently frozen against
+// mutation.
+func (v *Volume) ReadOnly() bool {
+	return v.readOnly.get()
+}
+
+// SetReadOnly freezes or unfreezes the volume: it persists the flag
+// and refreshes the in-memory cache FUSE operations consult.
+func (v *Volume) SetReadOnly(readOnly bool) error {
+	err := v.db.Update(func(tx *db.Tx) error {
+		return v.bucket(tx).SetReadOnly(readOnly)
+	})
+	if err != nil {
+		return err
+	}
+	v.readOnly.set(readOnly)
+	return nil
+}
+
+// checkWritable returns fuse.EROFS if the volume is read-only. FUSE
+// operations that mutate the tree -- Create, Mkdir, Rename, Remove,
+// Setattr, Write, Symlink -- call this first and return its result
+// unchanged when non-nil.
+func (v *Volume) checkWritable() error {
+	if v.readOnly.get() {
+		return fuse.EROFS
+	}
+	return nil
+}
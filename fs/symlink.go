@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"os"
+	"sync"
+
+	"bazil.org/bazil/fs/wire"
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// symlink is a symbolic link node in a Volume's FUSE tree.
+type symlink struct {
+	fs    *Volume
+	inode uint64
+
+	mu     sync.Mutex
+	name   string
+	target string
+}
+
+func newSymlink(fs *Volume, inode uint64, name string, target string) *symlink {
+	return &symlink{fs: fs, inode: inode, name: name, target: target}
+}
+
+var _ fs.Node = (*symlink)(nil)
+var _ fs.NodeReadlinker = (*symlink)(nil)
+var _ node = (*symlink)(nil)
+
+func (s *symlink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = s.inode
+	a.Mode = os.ModeSymlink | 0777
+	return nil
+}
+
+func (s *symlink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target, nil
+}
+
+func (s *symlink) setName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+func (s *symlink) marshal() (*wire.Dirent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &wire.Dirent{
+		Inode:   s.inode,
+		Symlink: &wire.Symlink{Target: s.target},
+	}, nil
+}
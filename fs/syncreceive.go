@@ -0,0 +1,433 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	"bazil.org/bazil/db"
+	"bazil.org/bazil/fs/clock"
+	"bazil.org/bazil/fs/inodes"
+	"bazil.org/bazil/fs/wire"
+	wirepeer "bazil.org/bazil/peer/wire"
+	"golang.org/x/net/context"
+)
+
+// syncReceiveWorkers bounds how many files SyncReceive reconstructs
+// concurrently.
+const syncReceiveWorkers = 8
+
+// syncReceiveBlockWorkers bounds how many of one file's blocks are
+// fetched concurrently by a single pullWorker.
+const syncReceiveBlockWorkers = 8
+
+// manifestKeySize is the length in bytes of one chunk key inside a
+// file's manifest. A manifest is the back-to-back encoding of the
+// keys of the blocks that make up the file, in order; SyncSend
+// forwards File.Manifest as an opaque blob without needing to
+// understand its contents, but SyncReceive must parse it to fetch the
+// blocks it names.
+const manifestKeySize = 32
+
+// parseManifest splits a file's manifest into the ordered list of
+// chunk keys it references.
+func parseManifest(manifest []byte) ([][]byte, error) {
+	if len(manifest)%manifestKeySize != 0 {
+		return nil, fmt.Errorf("malformed manifest: length %d is not a multiple of %d", len(manifest), manifestKeySize)
+	}
+	keys := make([][]byte, 0, len(manifest)/manifestKeySize)
+	for i := 0; i < len(manifest); i += manifestKeySize {
+		keys = append(keys, manifest[i:i+manifestKeySize])
+	}
+	return keys, nil
+}
+
+// blockFetcher dedups concurrent fetches of the same chunk key across
+// every pullWorker goroutine in one SyncReceive call, so that a block
+// shared by several files -- or referenced twice within one file --
+// is only fetched from v.chunkStore once.
+type blockFetcher struct {
+	mu      sync.Mutex
+	pending map[string]*blockFetch
+}
+
+type blockFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func newBlockFetcher() *blockFetcher {
+	return &blockFetcher{pending: make(map[string]*blockFetch)}
+}
+
+// fetch retrieves key through v.chunkStore, issuing at most one Get
+// for key no matter how many goroutines call fetch with it
+// concurrently; later callers block on and share the first's result.
+func (b *blockFetcher) fetch(v *Volume, key []byte) error {
+	k := string(key)
+
+	b.mu.Lock()
+	if f, ok := b.pending[k]; ok {
+		b.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &blockFetch{done: make(chan struct{})}
+	b.pending[k] = f
+	b.mu.Unlock()
+
+	_, err := v.chunkStore.Get(key)
+	f.err = err
+	close(f.done)
+	return err
+}
+
+// sharedPullerState tracks the reconstruction of a single file
+// received during SyncReceive. It is shared between the goroutine
+// that discovers the file's blocks and the worker pool that fetches
+// them; whichever worker drives the refcount to zero hands the
+// state to the finisher.
+type sharedPullerState struct {
+	mu sync.Mutex
+
+	dirInode uint64
+	name     string
+	dirent   *wirepeer.Dirent
+	clock    clock.Clock
+
+	pending int // outstanding block fetches
+	err     error
+
+	conflict bool // materialize as a conflict copy rather than overwrite
+}
+
+func (s *sharedPullerState) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *sharedPullerState) getErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// blockDone records that one outstanding block fetch has completed,
+// and reports whether this was the last one.
+func (s *sharedPullerState) blockDone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending--
+	return s.pending == 0
+}
+
+// SyncReceive drives a full pull from a peer. It reads items sent by
+// recv, one VolumeSyncPullItem at a time, and for each dirent
+// resolves the peer's clock against our own (under v.epoch.mu) to
+// decide whether to create, overwrite, make a conflict copy of, or
+// ignore it. Files are reconstructed by parsing their manifest into
+// the chunk keys it references and fetching each block through
+// v.chunkStore, using a bounded pool of workers that dedup concurrent
+// fetches of the same chunk key so that blocks shared between files --
+// or referenced more than once within one file -- are only fetched
+// once.
+//
+// A dirent is only committed -- its inode allocated, its clock and
+// directory entry written -- once every block it depends on has been
+// fetched successfully. Errors reconstructing one file do not stop
+// the others; SyncReceive discards that file's partial state and
+// keeps going, returning an aggregated error once recv is exhausted.
+func (v *Volume) SyncReceive(ctx context.Context, dirPath string, recv func() (*wirepeer.VolumeSyncPullItem, error)) error {
+	dirPath = path.Clean("/" + dirPath)[1:]
+
+	if v.ReadOnly() {
+		return ErrVolumeReadOnly
+	}
+
+	lockKey := v.lockKey(dirPath)
+	if !db.Locks.TryAcquire(lockKey) {
+		return db.ErrOperationInProgress
+	}
+	defer db.Locks.Release(lockKey)
+
+	pullers := make(chan *sharedPullerState)
+	finished := make(chan *sharedPullerState)
+	blocks := newBlockFetcher()
+
+	var wg sync.WaitGroup
+	wg.Add(syncReceiveWorkers)
+	for i := 0; i < syncReceiveWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			v.pullWorker(pullers, finished, blocks)
+		}()
+	}
+
+	finisherErrs := make(chan error, 1)
+	finisherDone := make(chan struct{})
+	go func() {
+		defer close(finisherDone)
+		finisherErrs <- v.syncReceiveFinisher(dirPath, finished)
+	}()
+
+	needErr := v.syncReceiveNeeder(ctx, dirPath, recv, pullers)
+
+	close(pullers)
+	wg.Wait()
+	close(finished)
+	<-finisherDone
+
+	if err := <-finisherErrs; err != nil {
+		if needErr == nil {
+			needErr = err
+		}
+	}
+	return needErr
+}
+
+// syncReceiveNeeder reads batches from the peer and enqueues a
+// sharedPullerState for every dirent that needs fetching, after
+// resolving its clock against the local tree.
+func (v *Volume) syncReceiveNeeder(ctx context.Context, dirPath string, recv func() (*wirepeer.VolumeSyncPullItem, error), pullers chan<- *sharedPullerState) error {
+	var dirInode uint64
+	if err := v.db.View(func(tx *db.Tx) error {
+		bucket := v.bucket(tx)
+		dirs := bucket.Dirs()
+
+		inode := v.root.inode
+		p := dirPath
+		for p != "" {
+			var seg string
+			seg, p = splitPath(p)
+			de, err := dirs.Get(inode, seg)
+			if err != nil {
+				return err
+			}
+			inode = de.Inode
+		}
+		dirInode = inode
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		item, err := recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, de := range item.Children {
+			theirClock, err := clock.Unmarshal(de.Clock)
+			if err != nil {
+				return err
+			}
+
+			v.epoch.mu.Lock()
+			decision, err := v.resolveSyncDirent(dirInode, de, theirClock)
+			v.epoch.mu.Unlock()
+			if err != nil {
+				return err
+			}
+			if decision == nil {
+				// Already up to date, or peer is behind us; nothing to do.
+				continue
+			}
+
+			pullers <- decision
+		}
+	}
+}
+
+// syncDecision values used internally by resolveSyncDirent.
+const (
+	syncIgnore = iota
+	syncCreate
+	syncOverwrite
+	syncConflict
+)
+
+// syncResolveAction decides what to do with an existing dirent given
+// how its clock compares to the incoming one: oursBeforeTheirs is
+// whether our clock happens-before theirs, theirsBeforeOurs the
+// reverse. Exactly one of the two may be true, since a clock cannot
+// happen-before itself; when neither holds, the clocks have diverged
+// and the dirent is a conflict.
+func syncResolveAction(oursBeforeTheirs, theirsBeforeOurs bool) int {
+	switch {
+	case oursBeforeTheirs:
+		return syncOverwrite
+	case theirsBeforeOurs:
+		return syncIgnore
+	default:
+		return syncConflict
+	}
+}
+
+// resolveSyncDirent compares the incoming dirent's clock against the
+// local one using vector-clock happens-before, and returns a
+// sharedPullerState describing the work needed to apply it, or nil if
+// nothing needs to be done. Caller must hold v.epoch.mu.
+func (v *Volume) resolveSyncDirent(dirInode uint64, de *wirepeer.Dirent, theirClock clock.Clock) (*sharedPullerState, error) {
+	var ours clock.Clock
+	var exists bool
+	if err := v.db.View(func(tx *db.Tx) error {
+		bucket := v.bucket(tx)
+		c, err := bucket.Clock().Get(dirInode, de.Name)
+		switch err {
+		case nil:
+			ours = c
+			exists = true
+		case db.ErrClockNotFound:
+			exists = false
+		default:
+			return err
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	action := syncCreate
+	if exists {
+		action = syncResolveAction(ours.HappensBefore(theirClock), theirClock.HappensBefore(ours))
+	}
+	if action == syncIgnore {
+		return nil, nil
+	}
+
+	return &sharedPullerState{
+		dirInode: dirInode,
+		name:     de.Name,
+		dirent:   de,
+		clock:    theirClock,
+		conflict: action == syncConflict,
+		pending:  1,
+	}, nil
+}
+
+// pullWorker fetches every block a sharedPullerState's file manifest
+// references, deduping identical chunk keys against the other
+// in-flight pullers (via blocks) so shared blocks are only fetched
+// once, then forwards the state to the finisher.
+func (v *Volume) pullWorker(pullers <-chan *sharedPullerState, finished chan<- *sharedPullerState, blocks *blockFetcher) {
+	for s := range pullers {
+		if s.dirent.File != nil {
+			if err := v.fetchManifestBlocks(s.dirent.File.Manifest, blocks); err != nil {
+				s.fail(fmt.Errorf("fetching blocks for %q: %v", s.name, err))
+			}
+		}
+		if s.blockDone() {
+			finished <- s
+		}
+	}
+}
+
+// fetchManifestBlocks parses manifest into its chunk keys and fetches
+// each one through blocks, up to syncReceiveBlockWorkers at a time.
+// blocks dedups identical keys against every other file pullWorker is
+// concurrently reconstructing in this SyncReceive call.
+func (v *Volume) fetchManifestBlocks(manifest []byte, blocks *blockFetcher) error {
+	keys, err := parseManifest(manifest)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, syncReceiveBlockWorkers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := blocks.fetch(v, key); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// syncReceiveFinisher commits completed pullers -- allocating an
+// inode and writing the dirent and clock into the bolt buckets in a
+// single db.Update -- or discards them on error, and aggregates the
+// errors seen across all files into one.
+func (v *Volume) syncReceiveFinisher(dirPath string, finished <-chan *sharedPullerState) error {
+	volume := volumeLabel(&v.volID)
+	var errs []error
+	for s := range finished {
+		if err := s.getErr(); err != nil {
+			syncReceiveErrorsTotal.WithLabelValues(volume).Inc()
+			errs = append(errs, err)
+			continue
+		}
+
+		err := v.db.Update(func(tx *db.Tx) error {
+			bucket := v.bucket(tx)
+			name := s.name
+			if s.conflict {
+				name = conflictName(name)
+			}
+
+			var de wire.Dirent
+			switch {
+			case s.dirent.File != nil:
+				de = wire.Dirent{
+					Inode: inodes.Dynamic(s.dirInode, name),
+					File:  &wire.File{Manifest: s.dirent.File.Manifest},
+				}
+			case s.dirent.Dir != nil:
+				de = wire.Dirent{
+					Inode: inodes.Dynamic(s.dirInode, name),
+					Dir:   &wire.Dir{},
+				}
+			default:
+				return fmt.Errorf("unknown dirent type for %q", s.name)
+			}
+
+			if err := bucket.Dirs().Put(s.dirInode, name, &de); err != nil {
+				return err
+			}
+			return bucket.Clock().Put(s.dirInode, name, s.clock)
+		})
+		if err != nil {
+			syncReceiveErrorsTotal.WithLabelValues(volume).Inc()
+			errs = append(errs, err)
+			continue
+		}
+		syncReceiveDirentsTotal.WithLabelValues(volume).Inc()
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return fmt.Errorf("%d files failed to sync: %v", len(errs), errs)
+}
+
+func conflictName(name string) string {
+	return name + ".sync-conflict"
+}
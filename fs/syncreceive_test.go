@@ -0,0 +1,23 @@
+package fs
+
+import "testing"
+
+func TestSyncResolveAction(t *testing.T) {
+	cases := []struct {
+		name                               string
+		oursBeforeTheirs, theirsBeforeOurs bool
+		want                               int
+	}{
+		{"ours stale, overwrite with theirs", true, false, syncOverwrite},
+		{"theirs stale, ignore", false, true, syncIgnore},
+		{"diverged, conflict", false, false, syncConflict},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := syncResolveAction(c.oursBeforeTheirs, c.theirsBeforeOurs)
+			if got != c.want {
+				t.Errorf("syncResolveAction(%v, %v) = %d, want %d", c.oursBeforeTheirs, c.theirsBeforeOurs, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"bazil.org/bazil/db"
+	"bazil.org/bazil/fs/wire"
+	wirepeer "bazil.org/bazil/peer/wire"
+	"golang.org/x/net/context"
+)
+
+// ErrSyncCursorStale is returned by SyncSend when a resumed batch
+// finds that the synced directory, or one of its ancestors, no longer
+// matches the state captured when the cursor was issued -- e.g. it
+// was renamed or replaced between batches. The peer should discard
+// the cursor and restart the sync from scratch.
+var ErrSyncCursorStale = errors.New("sync cursor is stale")
+
+// syncSendBatchSize bounds how many dirents SyncSend puts in one
+// VolumeSyncPullItem before sending it and checkpointing the cursor.
+const syncSendBatchSize = 1000
+
+// syncSendKeepaliveInterval bounds how long SyncSend can go without
+// writing to send before it emits a cursor-only keepalive item, so a
+// directory that takes a long time to enumerate -- far fewer than
+// syncSendBatchSize entries, but each one costly to resolve -- doesn't
+// look like a stalled stream to the peer. The keepalive resends the
+// most recent cursor, so none is sent until a cursor has been issued.
+const syncSendKeepaliveInterval = 5 * time.Second
+
+// syncSendCursor holds the most recently issued cursor so the
+// keepalive goroutine can resend it without racing the main loop that
+// produces new ones.
+type syncSendCursor struct {
+	mu     sync.Mutex
+	cursor []byte
+}
+
+func (c *syncSendCursor) set(cursor []byte) {
+	c.mu.Lock()
+	c.cursor = cursor
+	c.mu.Unlock()
+}
+
+func (c *syncSendCursor) get() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cursor
+}
+
+// syncSendPathSegment pins down one segment of the path from the
+// volume root to the directory being synced, as it was resolved for
+// one batch. Comparing these across batches -- each of which reopens
+// a fresh bolt snapshot -- is how SyncSend notices that the tree
+// changed underneath a resumed sync.
+type syncSendPathSegment struct {
+	parent uint64
+	name   string
+	clock  []byte
+}
+
+func syncSendPathUnchanged(a, b []syncSendPathSegment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].parent != b[i].parent || a[i].name != b[i].name || !bytes.Equal(a[i].clock, b[i].clock) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveSyncDir walks dirPath from the volume root inside tx,
+// returning the resolved directory's inode, its dirent (nil for the
+// root), and the clock of every path segment traversed.
+func (v *Volume) resolveSyncDir(tx *db.Tx, dirPath string) (inode uint64, segments []syncSendPathSegment, dirDE *wire.Dirent, err error) {
+	bucket := v.bucket(tx)
+	dirs := bucket.Dirs()
+	clocks := bucket.Clock()
+
+	inode = v.root.inode
+	for dirPath != "" {
+		var seg string
+		seg, dirPath = splitPath(dirPath)
+
+		de, err := dirs.Get(inode, seg)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		c, err := clocks.Get(inode, seg)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		clockBuf, err := c.MarshalBinary()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		segments = append(segments, syncSendPathSegment{parent: inode, name: seg, clock: clockBuf})
+
+		inode = de.Inode
+		dirDE = de
+	}
+	return inode, segments, dirDE, nil
+}
+
+// encodeSyncCursor packs the last dirent sent -- its name -- together
+// with the clock of every ancestor directory segment that was
+// resolved to reach it, into the opaque cursor token carried on the
+// wire. Embedding the ancestor clocks, rather than just inodes, is
+// what lets a resumed SyncSend notice that a directory was deleted
+// and recreated under the same name: inodes.Dynamic(parent, name) is
+// deterministic, so such a directory keeps the same inode but gets a
+// fresh clock.
+func encodeSyncCursor(segments []syncSendPathSegment, name string) []byte {
+	var buf bytes.Buffer
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], uint32(len(segments)))
+	buf.Write(n[:4])
+	for _, seg := range segments {
+		binary.BigEndian.PutUint64(n[:8], seg.parent)
+		buf.Write(n[:8])
+		putSyncCursorBytes(&buf, []byte(seg.name))
+		putSyncCursorBytes(&buf, seg.clock)
+	}
+	putSyncCursorBytes(&buf, []byte(name))
+	return buf.Bytes()
+}
+
+func decodeSyncCursor(cursor []byte) (segments []syncSendPathSegment, name string, err error) {
+	r := bytes.NewReader(cursor)
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, "", fmt.Errorf("decoding sync cursor: %v", err)
+	}
+	segments = make([]syncSendPathSegment, count)
+	for i := range segments {
+		if err := binary.Read(r, binary.BigEndian, &segments[i].parent); err != nil {
+			return nil, "", fmt.Errorf("decoding sync cursor: %v", err)
+		}
+		nameBuf, err := getSyncCursorBytes(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("decoding sync cursor: %v", err)
+		}
+		segments[i].name = string(nameBuf)
+		segments[i].clock, err = getSyncCursorBytes(r)
+		if err != nil {
+			return nil, "", fmt.Errorf("decoding sync cursor: %v", err)
+		}
+	}
+	nameBuf, err := getSyncCursorBytes(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding sync cursor: %v", err)
+	}
+	return segments, string(nameBuf), nil
+}
+
+// putSyncCursorBytes and getSyncCursorBytes encode a single
+// length-prefixed byte string within a sync cursor.
+func putSyncCursorBytes(buf *bytes.Buffer, b []byte) {
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(b)))
+	buf.Write(n[:])
+	buf.Write(b)
+}
+
+func getSyncCursorBytes(r *bytes.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SyncSend streams the dirents under dirPath to a peer, one batch per
+// VolumeSyncPullItem. If cursor is nil, it starts from the beginning;
+// otherwise it resumes immediately after the dirent the cursor
+// encodes, which must have come from a Cursor previously sent for
+// this same volume and dirPath. Every batch that reports children
+// carries a Cursor for the last of them, so a dropped connection can
+// resume without re-sending everything; a batch with no children
+// carries no Cursor. The final batch has Done set. If a batch takes
+// longer than syncSendKeepaliveInterval to assemble and a cursor has
+// already been issued, SyncSend resends that cursor as a cursor-only
+// keepalive item in the meantime so the peer doesn't mistake a slow
+// directory for a stalled stream; before the first cursor, no
+// keepalive is sent. If the directory or one of its ancestors changed since the
+// cursor was issued, SyncSend returns ErrSyncCursorStale and the
+// caller must restart from scratch.
+func (v *Volume) SyncSend(ctx context.Context, dirPath string, cursor []byte, send func(*wirepeer.VolumeSyncPullItem) error) error {
+	dirPath = path.Clean("/" + dirPath)[1:]
+
+	lockKey := v.lockKey(dirPath)
+	if !db.Locks.TryAcquire(lockKey) {
+		return db.ErrOperationInProgress
+	}
+	defer db.Locks.Release(lockKey)
+
+	// First, start a new epoch so all mutations happen after the
+	// clocks that are included in the snapshot.
+	v.epoch.mu.Lock()
+	_, err := v.cleanEpoch()
+	v.epoch.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	volume := volumeLabel(&v.volID)
+	var sendMu sync.Mutex
+	instrumentedSend := func(msg *wirepeer.VolumeSyncPullItem) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		syncSendDirentsTotal.WithLabelValues(volume).Add(float64(len(msg.Children)))
+		syncSendBytesTotal.WithLabelValues(volume).Add(float64(msg.Size()))
+		syncSendBatchesTotal.WithLabelValues(volume).Inc()
+		return send(msg)
+	}
+
+	var cursorSegments []syncSendPathSegment
+	var resumeName string
+	resuming := cursor != nil
+	if resuming {
+		segments, name, err := decodeSyncCursor(cursor)
+		if err != nil {
+			return err
+		}
+		cursorSegments = segments
+		resumeName = name
+	}
+
+	var lastCursor syncSendCursor
+	if cursor != nil {
+		lastCursor.set(cursor)
+	}
+	keepaliveStop := make(chan struct{})
+	keepaliveDone := make(chan struct{})
+	var keepaliveErrMu sync.Mutex
+	var keepaliveErr error
+	go func() {
+		defer close(keepaliveDone)
+		t := time.NewTicker(syncSendKeepaliveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-keepaliveStop:
+				return
+			case <-t.C:
+				c := lastCursor.get()
+				if c == nil {
+					continue
+				}
+				if err := instrumentedSend(&wirepeer.VolumeSyncPullItem{Cursor: c}); err != nil {
+					keepaliveErrMu.Lock()
+					if keepaliveErr == nil {
+						keepaliveErr = err
+					}
+					keepaliveErrMu.Unlock()
+					return
+				}
+			}
+		}
+	}()
+	stopKeepalive := func() error {
+		close(keepaliveStop)
+		<-keepaliveDone
+		keepaliveErrMu.Lock()
+		defer keepaliveErrMu.Unlock()
+		return keepaliveErr
+	}
+
+	var pathSegments []syncSendPathSegment
+	sentPeers := false
+	for {
+		var msg *wirepeer.VolumeSyncPullItem
+		var done bool
+
+		err := v.db.View(func(tx *db.Tx) error {
+			dirInode, segments, dirDE, err := v.resolveSyncDir(tx, dirPath)
+			if err != nil {
+				return err
+			}
+			if pathSegments == nil {
+				// First batch of this call. If we're resuming a cursor
+				// handed to us after a reconnect, this is the only
+				// chance to catch staleness: compare the ancestor
+				// clocks it carries against what the tree looks like
+				// now, since there is no earlier in-process state to
+				// fall back on.
+				if resuming && !syncSendPathUnchanged(cursorSegments, segments) {
+					return ErrSyncCursorStale
+				}
+				pathSegments = segments
+			} else if !syncSendPathUnchanged(pathSegments, segments) {
+				return ErrSyncCursorStale
+			}
+
+			if dirDE != nil && dirDE.Dir == nil {
+				msg = &wirepeer.VolumeSyncPullItem{
+					Error: wirepeer.VolumeSyncPullItem_NOT_A_DIRECTORY,
+				}
+				done = true
+				return nil
+			}
+
+			bucket := v.bucket(tx)
+			dirs := bucket.Dirs()
+			clocks := bucket.Clock()
+
+			m := &wirepeer.VolumeSyncPullItem{}
+			if !sentPeers {
+				m.Peers = map[uint32][]byte{
+					// PeerID 0 always refers to myself.
+					0: v.pubKey[:],
+				}
+				peerCursor := tx.Peers().Cursor()
+				for peer := peerCursor.First(); peer != nil; peer = peerCursor.Next() {
+					// filter what ids are returned here to include only
+					// peers authorized for current volumes; avoids
+					// leaking information about all of our peers.
+					if !peer.Volumes().IsAllowed(bucket) {
+						continue
+					}
+					// TODO hardcoded knowledge of size of peer.ID
+					m.Peers[uint32(peer.ID())] = peer.Pub()[:]
+				}
+				sentPeers = true
+			}
+
+			c := dirs.List(dirInode)
+			item := c.First()
+			if resuming {
+				item = c.Seek(resumeName)
+				if item != nil && item.Name() == resumeName {
+					item = c.Next()
+				}
+				resuming = false
+			}
+
+			for ; item != nil; item = c.Next() {
+				name := item.Name()
+
+				var tmp wire.Dirent
+				if err := item.Unmarshal(&tmp); err != nil {
+					return err
+				}
+
+				de := &wirepeer.Dirent{Name: name}
+				switch {
+				case tmp.File != nil:
+					de.File = &wirepeer.File{
+						Manifest: tmp.File.Manifest,
+					}
+				case tmp.Dir != nil:
+					de.Dir = &wirepeer.Dir{}
+				default:
+					return fmt.Errorf("unknown dirent type: %v", tmp)
+				}
+
+				clock, err := clocks.Get(dirInode, name)
+				if err != nil {
+					return err
+				}
+				// TODO more complex db api would avoid unmarshal-marshal
+				// hoops
+				clockBuf, err := clock.MarshalBinary()
+				if err != nil {
+					return err
+				}
+				de.Clock = clockBuf
+
+				// TODO executable, xattr, acl
+				// TODO mtime
+
+				m.Children = append(m.Children, de)
+				m.Cursor = encodeSyncCursor(segments, name)
+
+				if len(m.Children) >= syncSendBatchSize {
+					// The next batch reopens a snapshot; pick up after this dirent.
+					resumeName = name
+					resuming = true
+					msg = m
+					return nil
+				}
+			}
+
+			done = true
+			msg = m
+			return nil
+		})
+		if err != nil {
+			stopKeepalive()
+			return err
+		}
+
+		msg.Done = done
+		if msg.Cursor != nil {
+			lastCursor.set(msg.Cursor)
+		}
+		if len(msg.Children) > 0 || msg.Cursor != nil || msg.Peers != nil || msg.Done || msg.Error != 0 {
+			if err := instrumentedSend(msg); err != nil {
+				stopKeepalive()
+				return err
+			}
+		}
+		if done {
+			if err := stopKeepalive(); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+}
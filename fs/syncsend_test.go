@@ -0,0 +1,61 @@
+package fs
+
+import (
+	"testing"
+)
+
+func TestSyncCursorRoundTrip(t *testing.T) {
+	segments := []syncSendPathSegment{
+		{parent: 1, name: "home", clock: []byte{0x01, 0x02}},
+		{parent: 42, name: "docs", clock: []byte{}},
+	}
+
+	cursor := encodeSyncCursor(segments, "report.txt")
+
+	gotSegments, gotName, err := decodeSyncCursor(cursor)
+	if err != nil {
+		t.Fatalf("decodeSyncCursor: %v", err)
+	}
+	if gotName != "report.txt" {
+		t.Errorf("name = %q, want %q", gotName, "report.txt")
+	}
+	if !syncSendPathUnchanged(gotSegments, segments) {
+		t.Errorf("segments = %+v, want %+v", gotSegments, segments)
+	}
+}
+
+func TestSyncCursorRoundTripNoSegments(t *testing.T) {
+	cursor := encodeSyncCursor(nil, "toplevel.txt")
+
+	gotSegments, gotName, err := decodeSyncCursor(cursor)
+	if err != nil {
+		t.Fatalf("decodeSyncCursor: %v", err)
+	}
+	if gotName != "toplevel.txt" {
+		t.Errorf("name = %q, want %q", gotName, "toplevel.txt")
+	}
+	if len(gotSegments) != 0 {
+		t.Errorf("segments = %+v, want none", gotSegments)
+	}
+}
+
+func TestSyncCursorDetectsChangedClock(t *testing.T) {
+	before := []syncSendPathSegment{{parent: 1, name: "home", clock: []byte{0x01}}}
+	after := []syncSendPathSegment{{parent: 1, name: "home", clock: []byte{0x02}}}
+
+	cursor := encodeSyncCursor(before, "report.txt")
+	gotSegments, _, err := decodeSyncCursor(cursor)
+	if err != nil {
+		t.Fatalf("decodeSyncCursor: %v", err)
+	}
+	if syncSendPathUnchanged(gotSegments, after) {
+		t.Error("syncSendPathUnchanged reported no change across a clock bump, want changed")
+	}
+}
+
+func TestDecodeSyncCursorTruncated(t *testing.T) {
+	cursor := encodeSyncCursor([]syncSendPathSegment{{parent: 1, name: "home", clock: []byte{0x01}}}, "report.txt")
+	if _, _, err := decodeSyncCursor(cursor[:len(cursor)-1]); err == nil {
+		t.Error("decodeSyncCursor on truncated input: expected error, got nil")
+	}
+}